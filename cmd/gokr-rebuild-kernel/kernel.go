@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,14 +12,47 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
+// builder selects how the Dockerfile below is turned into a built and run
+// container. docker and podman shell out to the respective CLI; native
+// builds and runs the container in-process (see native.go), requiring
+// neither a running daemon nor root.
+var builder = flag.String("builder", "docker", "container builder to use: docker, podman, or native (daemonless, rootless, no dockerd required; USER is a no-op and every instruction runs as the build user namespace's mapped root -- see chrootCommandArgs)")
+
+var targetNames = flag.String("targets", "rpi3", "comma-separated list of targets to (re)build, e.g. rpi3,rpi4,rpi-cm4 (see targetRegistry for the full list)")
+
+// sourceDateEpochFlag pins SOURCE_DATE_EPOCH (and the KBUILD_BUILD_*
+// variables derived from it) so that rebuilding the same patch set always
+// produces a bit-for-bit identical vmlinuz. Defaults to the newest patch
+// file's mtime, matching the usual SOURCE_DATE_EPOCH convention for
+// reproducible Debian-style builds.
+var sourceDateEpochFlag = flag.Int64("source-date-epoch", 0, "SOURCE_DATE_EPOCH unix timestamp to build with (default: newest patch file's mtime)")
+
+var patchDir = flag.String("patch-dir", "patches", "directory of quilt-style NNNN-description.patch files to apply, honoring a series file if present (see discoverPatches)")
+
+var allowZeroPatches = flag.Bool("allow-zero-patches", false, "build even if -patch-dir resolves zero patches, instead of erroring out (use when you really mean to build vanilla upstream)")
+
+const baseImageRef = "debian:stretch"
+
 const dockerFileContents = `
-FROM debian:stretch
+FROM {{ .BaseImage }}
 
-RUN apt-get update && apt-get install -y crossbuild-essential-arm64 bc libssl-dev bison flex
+ARG SOURCE_DATE_EPOCH
+ARG KBUILD_BUILD_TIMESTAMP
+ARG KBUILD_BUILD_USER
+ARG KBUILD_BUILD_HOST
+ENV SOURCE_DATE_EPOCH $SOURCE_DATE_EPOCH
+ENV KBUILD_BUILD_TIMESTAMP $KBUILD_BUILD_TIMESTAMP
+ENV KBUILD_BUILD_USER $KBUILD_BUILD_USER
+ENV KBUILD_BUILD_HOST $KBUILD_BUILD_HOST
+
+RUN apt-get update && apt-get install -y {{ .CrossPackage }} bc libssl-dev bison flex
 
 COPY gokr-build-kernel /usr/bin/gokr-build-kernel
 {{- range $idx, $path := .Patches }}
@@ -26,9 +62,10 @@ COPY {{ $path }} /usr/src/{{ $path }}
 RUN echo 'builduser:x:{{ .Uid }}:{{ .Gid }}:nobody:/:/bin/sh' >> /etc/passwd && \
     chown -R {{ .Uid }}:{{ .Gid }} /usr/src
 
+ENV GOKR_KERNEL_TARGET {{ .Target }}
 USER builduser
 WORKDIR /usr/src
-ENTRYPOINT /usr/bin/gokr-build-kernel
+ENTRYPOINT /bin/sh -c "dpkg -l > /tmp/buildresult/packages.txt && /usr/bin/gokr-build-kernel"
 `
 
 var dockerFileTmpl = template.Must(template.New("dockerfile").
@@ -39,11 +76,148 @@ var dockerFileTmpl = template.Must(template.New("dockerfile").
 	}).
 	Parse(dockerFileContents))
 
-var patchFiles = []string{
-	"0001-Revert-add-index-to-the-ethernet-alias.patch",
-	// serial
-	"0101-expose-UART0-ttyAMA0-on-GPIO-14-15-disable-UART1-tty.patch",
-	"0102-expose-UART0-ttyAMA0-on-GPIO-14-15-disable-UART1-tty.patch",
+// discoverPatches lists which patches to apply for target, without requiring
+// a recompile to add or remove one. It checks, in order: a target-specific
+// series file (patchDir/target/series), a shared series file
+// (patchDir/series), and otherwise every *.patch file directly in patchDir,
+// sorted lexicographically so the existing 0001-/0101- quilt-style numbering
+// already sorts into apply order.
+//
+// A patchDir that resolves zero patches is rejected unless allowZero is set
+// (see -allow-zero-patches): an empty result here used to mean "build
+// proceeds with no patches applied", silently shipping a kernel missing
+// whatever the patch set was supposed to carry (e.g. a MAC-address revert or
+// serial-console enablement), with no error to flag it.
+func discoverPatches(patchDir, target string, allowZero bool) ([]string, error) {
+	patches, err := discoverPatchesUnchecked(patchDir, target)
+	if err != nil {
+		return nil, err
+	}
+	if len(patches) == 0 && !allowZero {
+		return nil, fmt.Errorf("%s resolved zero patches for target %q; pass -allow-zero-patches if that's intentional", patchDir, target)
+	}
+	return patches, nil
+}
+
+func discoverPatchesUnchecked(patchDir, target string) ([]string, error) {
+	if series, err := readSeriesFile(filepath.Join(patchDir, target, "series")); err == nil {
+		return series, nil
+	}
+	if series, err := readSeriesFile(filepath.Join(patchDir, "series")); err == nil {
+		return series, nil
+	}
+
+	entries, err := os.ReadDir(patchDir)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %v (pass -patch-dir to point at your patches)", patchDir, err)
+	}
+	var patches []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".patch") {
+			continue
+		}
+		patches = append(patches, entry.Name())
+	}
+	sort.Strings(patches)
+	return patches, nil
+}
+
+// readSeriesFile parses a Debian/quilt-style series file: one patch file
+// name per line, blank lines and "#"-comments ignored, any trailing quilt
+// patch options (e.g. "-p1") discarded.
+func readSeriesFile(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var patches []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patches = append(patches, strings.Fields(line)[0])
+	}
+	return patches, nil
+}
+
+// findPatch locates filename, preferring a target-specific subdirectory of
+// patchDir, then patchDir itself, then the repository root (via find), so
+// that drop-in patches work without editing this file.
+func findPatch(patchDir, target, filename string) (string, error) {
+	if path := filepath.Join(patchDir, target, filename); fileExists(path) {
+		return path, nil
+	}
+	if path := filepath.Join(patchDir, filename); fileExists(path) {
+		return path, nil
+	}
+	return find(filename)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Target describes one board/SoC that gokr-build-kernel knows how to cross
+// compile for. CrossPackage selects the Debian crossbuild-essential
+// metapackage installed into the build container; GOKR_KERNEL_TARGET (see
+// dockerFileContents) tells gokr-build-kernel itself which defconfig and
+// patch set to use. KernelOutput is the vmlinuz file name this target is
+// committed under at the repository root.
+type Target struct {
+	Name         string
+	CrossPackage string
+	DTBs         []string
+	KernelOutput string
+}
+
+// targetRegistry lists every board -targets can select. Add an entry here
+// to support a new board without touching the rest of this file.
+var targetRegistry = map[string]Target{
+	"rpi3": {
+		Name:         "rpi3",
+		CrossPackage: "crossbuild-essential-arm64",
+		DTBs: []string{
+			"bcm2710-rpi-3-b.dtb",
+			"bcm2710-rpi-3-b-plus.dtb",
+		},
+		KernelOutput: "vmlinuz",
+	},
+	"rpi4": {
+		Name:         "rpi4",
+		CrossPackage: "crossbuild-essential-arm64",
+		DTBs:         []string{"bcm2711-rpi-4-b.dtb"},
+		KernelOutput: "vmlinuz-rpi4",
+	},
+	"rpi-cm4": {
+		Name:         "rpi-cm4",
+		CrossPackage: "crossbuild-essential-arm64",
+		DTBs:         []string{"bcm2711-rpi-cm4.dtb"},
+		KernelOutput: "vmlinuz-rpi-cm4",
+	},
+}
+
+func parseTargets(names string) ([]Target, error) {
+	var targets []Target
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		target, ok := targetRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown target %q (known targets: %s)", name, strings.Join(targetNamesList(), ", "))
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func targetNamesList() []string {
+	var names []string
+	for name := range targetRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func copyFile(dest, src string) error {
@@ -97,12 +271,30 @@ func find(filename string) (string, error) {
 }
 
 func main() {
+	flag.Parse()
+
+	targets, err := parseTargets(*targetNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, target := range targets {
+		log.Printf("building target %s", target.Name)
+		if err := buildTarget(target); err != nil {
+			log.Fatalf("building target %s: %v", target.Name, err)
+		}
+	}
+}
+
+// buildTarget cross-compiles the kernel and DTBs for target, leaving the
+// results at target.KernelOutput and target.DTBs in the repository root.
+func buildTarget(target Target) error {
 	// We explicitly use /tmp, because Docker only allows volume mounts under
 	// certain paths on certain platforms, see
 	// e.g. https://docs.docker.com/docker-for-mac/osxfs/#namespaces for macOS.
 	tmp, err := ioutil.TempDir("/tmp", "gokr-rebuild-kernel")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer os.RemoveAll(tmp)
 
@@ -111,105 +303,234 @@ func main() {
 	cmd.Env = append(os.Environ(), "GOOS=linux")
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
-		log.Fatalf("%v: %v", cmd.Args, err)
+		return fmt.Errorf("%v: %v", cmd.Args, err)
 	}
 
 	buildPath := filepath.Join(tmp, "gokr-build-kernel")
 
+	patchNames, err := discoverPatches(*patchDir, target.Name, *allowZeroPatches)
+	if err != nil {
+		return err
+	}
 	var patchPaths []string
-	for _, filename := range patchFiles {
-		path, err := find(filename)
+	for _, filename := range patchNames {
+		path, err := findPatch(*patchDir, target.Name, filename)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		patchPaths = append(patchPaths, path)
 	}
 
-	kernelPath, err := find("vmlinuz")
+	kernelPath, err := find(target.KernelOutput)
 	if err != nil {
-		log.Fatal(err)
-	}
-	dtbPath, err := find("bcm2710-rpi-3-b.dtb")
-	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	dtbPlusPath, err := find("bcm2710-rpi-3-b-plus.dtb")
-	if err != nil {
-		log.Fatal(err)
+	var dtbPaths []string
+	for _, dtb := range target.DTBs {
+		dtbPath, err := find(dtb)
+		if err != nil {
+			return err
+		}
+		dtbPaths = append(dtbPaths, dtbPath)
 	}
 
 	// Copy all files into the temporary directory so that docker
 	// includes them in the build context.
 	for _, path := range patchPaths {
 		if err := copyFile(filepath.Join(tmp, filepath.Base(path)), path); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 
 	u, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	dockerFile, err := os.Create(filepath.Join(tmp, "Dockerfile"))
-	if err != nil {
-		log.Fatal(err)
+
+	sourceDateEpoch := *sourceDateEpochFlag
+	if sourceDateEpoch == 0 {
+		for _, path := range patchPaths {
+			st, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if mtime := st.ModTime().Unix(); mtime > sourceDateEpoch {
+				sourceDateEpoch = mtime
+			}
+		}
+	}
+	buildArgs := map[string]string{
+		"SOURCE_DATE_EPOCH":      strconv.FormatInt(sourceDateEpoch, 10),
+		"KBUILD_BUILD_TIMESTAMP": time.Unix(sourceDateEpoch, 0).UTC().Format(time.RFC1123Z),
+		"KBUILD_BUILD_USER":      "gokrazy",
+		"KBUILD_BUILD_HOST":      "gokrazy",
 	}
 
-	if err := dockerFileTmpl.Execute(dockerFile, struct {
-		Uid       string
-		Gid       string
-		BuildPath string
-		Patches   []string
+	var dockerFileBuf bytes.Buffer
+	if err := dockerFileTmpl.Execute(&dockerFileBuf, struct {
+		Uid          string
+		Gid          string
+		BuildPath    string
+		Patches      []string
+		CrossPackage string
+		Target       string
+		BaseImage    string
 	}{
-		Uid:       u.Uid,
-		Gid:       u.Gid,
-		BuildPath: buildPath,
-		Patches:   patchFiles,
+		Uid:          u.Uid,
+		Gid:          u.Gid,
+		BuildPath:    buildPath,
+		Patches:      patchNames,
+		CrossPackage: target.CrossPackage,
+		Target:       target.Name,
+		BaseImage:    baseImageRef,
 	}); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	if err := dockerFile.Close(); err != nil {
-		log.Fatal(err)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "Dockerfile"), dockerFileBuf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	var baseImageDigest string
+
+	switch *builder {
+	case "docker", "podman":
+		log.Printf("building %s container for kernel compilation", *builder)
+
+		build := exec.Command(*builder, "build", "--rm=true", "--tag=gokr-rebuild-kernel")
+		for k, v := range buildArgs {
+			build.Args = append(build.Args, "--build-arg", k+"="+v)
+		}
+		build.Args = append(build.Args, ".")
+		build.Dir = tmp
+		build.Stdout = os.Stdout
+		build.Stderr = os.Stderr
+		if err := build.Run(); err != nil {
+			return fmt.Errorf("%s build: %v (cmd: %v)", *builder, err, build.Args)
+		}
+
+		if digest, err := exec.Command(*builder, "inspect", "--format={{index .RepoDigests 0}}", baseImageRef).Output(); err == nil {
+			baseImageDigest = strings.TrimSpace(string(digest))
+		}
+
+		log.Printf("compiling kernel")
+
+		run := exec.Command(*builder,
+			"run",
+			"--rm",
+			"--volume", tmp+":/tmp/buildresult:Z",
+			"gokr-rebuild-kernel")
+		run.Dir = tmp
+		run.Stdout = os.Stdout
+		run.Stderr = os.Stderr
+		if err := run.Run(); err != nil {
+			return fmt.Errorf("%s run: %v (cmd: %v)", *builder, err, run.Args)
+		}
+
+	case "native":
+		log.Printf("compiling kernel using the native (daemonless) builder")
+		digest, err := buildNative(tmp, dockerFileBuf.String(), buildArgs)
+		if err != nil {
+			return fmt.Errorf("native build: %v", err)
+		}
+		baseImageDigest = digest
+
+	default:
+		return fmt.Errorf("unknown -builder %q (want docker, podman, or native)", *builder)
 	}
 
-	log.Printf("building docker container for kernel compilation")
+	if err := copyFile(kernelPath, filepath.Join(tmp, target.KernelOutput)); err != nil {
+		return err
+	}
 
-	dockerBuild := exec.Command("docker",
-		"build",
-		"--rm=true",
-		"--tag=gokr-rebuild-kernel",
-		".")
-	dockerBuild.Dir = tmp
-	dockerBuild.Stdout = os.Stdout
-	dockerBuild.Stderr = os.Stderr
-	if err := dockerBuild.Run(); err != nil {
-		log.Fatalf("docker build: %v (cmd: %v)", err, dockerBuild.Args)
+	for i, dtbPath := range dtbPaths {
+		if err := copyFile(dtbPath, filepath.Join(tmp, target.DTBs[i])); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("compiling kernel")
+	return writeManifest(target, tmp, kernelPath, dtbPaths, patchPaths, sourceDateEpoch, baseImageDigest)
+}
+
+// buildManifest describes the inputs and outputs of one buildTarget run, so
+// that downstream users of gokrazy/kernel can verify a rebuild reproduces
+// the vmlinuz/DTBs shipped in this repository. It intentionally has no
+// kernel-tarball URL/hash field: gokr-build-kernel fetches the upstream
+// kernel source itself and does not currently report the URL or hash it
+// used back to this tool, so there is nothing honest to put there yet. That
+// means this manifest can verify patches/toolchain/outputs but not the
+// kernel source tarball itself -- plumbing that through needs a change to
+// gokr-build-kernel, tracked as a follow-up, not silently closed out here.
+type buildManifest struct {
+	Target            string            `json:"target"`
+	SourceDateEpoch   int64             `json:"source_date_epoch"`
+	BaseImage         string            `json:"base_image"`
+	BaseImageDigest   string            `json:"base_image_digest,omitempty"`
+	Patches           map[string]string `json:"patches"`
+	ToolchainPackages map[string]string `json:"toolchain_packages,omitempty"`
+	Outputs           map[string]string `json:"outputs"`
+}
 
-	dockerRun := exec.Command("docker",
-		"run",
-		"--rm",
-		"--volume", tmp+":/tmp/buildresult:Z",
-		"gokr-rebuild-kernel")
-	dockerRun.Dir = tmp
-	dockerRun.Stdout = os.Stdout
-	dockerRun.Stderr = os.Stderr
-	if err := dockerRun.Run(); err != nil {
-		log.Fatalf("docker run: %v (cmd: %v)", err, dockerRun.Args)
+func writeManifest(target Target, tmp, kernelPath string, dtbPaths, patchPaths []string, sourceDateEpoch int64, baseImageDigest string) error {
+	m := buildManifest{
+		Target:          target.Name,
+		SourceDateEpoch: sourceDateEpoch,
+		BaseImage:       baseImageRef,
+		BaseImageDigest: baseImageDigest,
+		Patches:         map[string]string{},
+		Outputs:         map[string]string{},
 	}
 
-	if err := copyFile(kernelPath, filepath.Join(tmp, "vmlinuz")); err != nil {
-		log.Fatal(err)
+	for _, path := range patchPaths {
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		m.Patches[filepath.Base(path)] = hash
 	}
 
-	if err := copyFile(dtbPath, filepath.Join(tmp, "bcm2710-rpi-3-b.dtb")); err != nil {
-		log.Fatal(err)
+	if packages, err := parsePackagesTxt(filepath.Join(tmp, "packages.txt")); err == nil {
+		m.ToolchainPackages = packages
 	}
 
-	if err := copyFile(dtbPlusPath, filepath.Join(tmp, "bcm2710-rpi-3-b-plus.dtb")); err != nil {
-		log.Fatal(err)
+	kernelHash, err := hashFile(kernelPath)
+	if err != nil {
+		return err
+	}
+	m.Outputs[filepath.Base(kernelPath)] = kernelHash
+	for _, dtbPath := range dtbPaths {
+		dtbHash, err := hashFile(dtbPath)
+		if err != nil {
+			return err
+		}
+		m.Outputs[filepath.Base(dtbPath)] = dtbHash
+	}
+
+	manifestPath := kernelPath + ".manifest.json"
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, b, 0644)
+}
+
+// parsePackagesTxt parses the `dpkg -l` output captured by the build
+// container's entrypoint into a map of package name to installed version.
+func parsePackagesTxt(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	packages := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "ii ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		packages[fields[1]] = fields[2]
 	}
+	return packages, nil
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePackagesTxt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "packages.txt")
+	content := `Desired=Unknown/Install/Remove/Purge/Hold
+| Status=Not/Inst/Conf-files/Unpacked/halF-conf/Half-inst/trig-aWait/Trig-pend
+|/ Err?=(none)/Reinst-required (Status,Err: uppercase=bad)
+||/ Name           Version      Architecture Description
++++-==============-============-============-=================
+ii  bc             1.07.1-2     amd64        GNU bc arbitrary precision calculator
+ii  bison           2:3.0.4.dfsg amd64        YACC-compatible parser generator
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parsePackagesTxt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"bc": "1.07.1-2", "bison": "2:3.0.4.dfsg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePackagesTxt() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+// native.go implements -builder=native: an in-process equivalent of
+// `docker build && docker run` that needs neither a running dockerd nor
+// root, modeled after how imagebuilder/kaniko assemble images. It parses
+// the rendered Dockerfile (see dockerFileContents) into an instruction
+// list, pulls the base image straight from the registry, and then
+// replays COPY/RUN/WORKDIR/ENTRYPOINT against a plain chroot inside a
+// user namespace (USER is accepted but ignored, see chrootCommandArgs).
+// Each instruction's resulting rootfs is
+// cached as a content-addressed tarball so that re-running the build
+// after only editing the last patch skips straight to applying it,
+// instead of redoing the apt-get install.
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// nativeInstruction is one parsed line of the rendered Dockerfile.
+type nativeInstruction struct {
+	op   string // FROM, ARG, ENV, RUN, COPY, USER, WORKDIR, ENTRYPOINT
+	args string
+}
+
+func parseDockerfile(contents string) ([]nativeInstruction, error) {
+	var instructions []nativeInstruction
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed Dockerfile line: %q", line)
+		}
+		instructions = append(instructions, nativeInstruction{
+			op:   strings.ToUpper(fields[0]),
+			args: strings.TrimSpace(fields[1]),
+		})
+	}
+	return instructions, scanner.Err()
+}
+
+// nativeLayerCache stores full rootfs snapshots keyed by the hash of the
+// instruction chain that produced them.
+type nativeLayerCache struct {
+	dir string
+}
+
+func newNativeLayerCache() (*nativeLayerCache, error) {
+	cacheRoot, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(cacheRoot, "gokr-rebuild-kernel", "layers")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &nativeLayerCache{dir: dir}, nil
+}
+
+func (c *nativeLayerCache) path(hash string) string { return filepath.Join(c.dir, hash+".tar") }
+
+func (c *nativeLayerCache) has(hash string) bool {
+	_, err := os.Stat(c.path(hash))
+	return err == nil
+}
+
+func (c *nativeLayerCache) save(hash, rootfs string) error {
+	out, err := os.Create(c.path(hash))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return tarDir(rootfs, out)
+}
+
+func (c *nativeLayerCache) restore(hash, rootfs string) error {
+	in, err := os.Open(c.path(hash))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.RemoveAll(rootfs); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+	return untar(in, rootfs)
+}
+
+// buildNative runs the given (already rendered) Dockerfile against buildCtx
+// without a container daemon, leaving build results under
+// buildCtx/rootfs/tmp/buildresult copied back into buildCtx, matching what
+// the `--volume buildCtx:/tmp/buildresult` docker/podman run does. It
+// returns the digest of the pulled FROM image, for inclusion in the build
+// manifest. buildArgs supplies the values for every ARG instruction,
+// mirroring `docker build --build-arg`.
+func buildNative(buildCtx, dockerfile string, buildArgs map[string]string) (string, error) {
+	instructions, err := parseDockerfile(dockerfile)
+	if err != nil {
+		return "", err
+	}
+
+	cache, err := newNativeLayerCache()
+	if err != nil {
+		return "", err
+	}
+
+	rootfs := filepath.Join(buildCtx, "rootfs")
+	hash := sha256.New()
+	workdir := "/"
+	env := map[string]string{}
+	args := map[string]string{}
+	var baseImageDigest string
+
+	applyOrCache := func(step func() error) error {
+		layerHash := hex.EncodeToString(hash.Sum(nil))
+		if cache.has(layerHash) {
+			return cache.restore(layerHash, rootfs)
+		}
+		if err := step(); err != nil {
+			return err
+		}
+		return cache.save(layerHash, rootfs)
+	}
+
+	for _, inst := range instructions {
+		switch inst.op {
+		case "FROM":
+			digest, err := resolveDigest(inst.args)
+			if err != nil {
+				return "", fmt.Errorf("resolving digest of %s: %v", inst.args, err)
+			}
+			baseImageDigest = digest
+			// Hash the resolved digest, not just the tag text: otherwise a
+			// retagged base image (same "debian:stretch", new upstream
+			// content) would hit the cache of the old rootfs forever, while
+			// baseImageDigest in the manifest reported the new one.
+			fmt.Fprintf(hash, "FROM %s@%s\n", inst.args, digest)
+			if err := applyOrCache(func() error {
+				return pullImageRootfs(inst.args, rootfs)
+			}); err != nil {
+				return "", fmt.Errorf("pulling %s: %v", inst.args, err)
+			}
+
+		case "ARG":
+			args[inst.args] = buildArgs[inst.args]
+
+		case "COPY":
+			parts := strings.Fields(inst.args)
+			if len(parts) != 2 {
+				return "", fmt.Errorf("COPY expects 2 arguments, got %q", inst.args)
+			}
+			src, dst := parts[0], parts[1]
+			srcHash, err := hashFile(filepath.Join(buildCtx, src))
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(hash, "COPY %s %s %s\n", src, dst, srcHash)
+			if err := applyOrCache(func() error {
+				return copyIntoRootfs(rootfs, filepath.Join(buildCtx, src), dst)
+			}); err != nil {
+				return "", fmt.Errorf("COPY %s: %v", inst.args, err)
+			}
+
+		case "RUN":
+			fmt.Fprintf(hash, "RUN %s\n", inst.args)
+			wd, e := workdir, env
+			if err := applyOrCache(func() error {
+				return runInRootfs(rootfs, wd, e, inst.args)
+			}); err != nil {
+				return "", fmt.Errorf("RUN %s: %v", inst.args, err)
+			}
+
+		case "USER":
+			// No-op: see the doc comment on chrootCommandArgs.
+
+		case "WORKDIR":
+			workdir = inst.args
+
+		case "ENV":
+			k, v, ok := strings.Cut(inst.args, " ")
+			if !ok {
+				return "", fmt.Errorf("malformed ENV instruction %q, want \"KEY value\"", inst.args)
+			}
+			v = strings.TrimSpace(v)
+			if name, isVar := strings.CutPrefix(v, "$"); isVar {
+				v = args[name]
+			}
+			env[k] = v
+
+		case "ENTRYPOINT":
+			// The docker/podman path gets /tmp/buildresult for free from
+			// `--volume tmp:/tmp/buildresult`; emulate that mount point here
+			// so the entrypoint (which writes packages.txt and the kernel
+			// build output there) has somewhere to write to.
+			if err := os.MkdirAll(filepath.Join(rootfs, "tmp", "buildresult"), 0755); err != nil {
+				return "", err
+			}
+			if err := runInRootfs(rootfs, workdir, env, inst.args); err != nil {
+				return "", fmt.Errorf("ENTRYPOINT %s: %v", inst.args, err)
+			}
+
+		default:
+			return "", fmt.Errorf("unsupported Dockerfile instruction %q", inst.op)
+		}
+	}
+
+	if err := copyDirContents(filepath.Join(rootfs, "tmp", "buildresult"), buildCtx); err != nil {
+		return "", err
+	}
+	return baseImageDigest, nil
+}
+
+// resolveDigest returns the registry digest of ref, for the build manifest.
+func resolveDigest(ref string) (string, error) {
+	tag, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	desc, err := remote.Get(tag)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
+
+// pullImageRootfs fetches ref straight from the registry and unpacks every
+// layer into rootfs, without ever invoking a container daemon.
+func pullImageRootfs(ref, rootfs string) error {
+	tag, err := name.ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	img, err := remote.Image(tag)
+	if err != nil {
+		return err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(rootfs); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return err
+		}
+		err = untar(rc, rootfs)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chrootCommandArgs builds the argv for running shcmd chrooted into rootfs
+// inside a fresh user namespace. `unshare --map-root-user` only maps a
+// single id (the invoking user's real uid/gid to namespace root); there is
+// no second id left to drop privileges to with `su`, so the command always
+// runs as the namespace's (sole) root. USER is therefore a no-op for the
+// native builder -- see the call site in buildNative.
+func chrootCommandArgs(rootfs, workdir string, env map[string]string, shcmd string) []string {
+	var keys []string
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var exports strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&exports, "export %s=%s; ", k, shellQuote(env[k]))
+	}
+	inner := fmt.Sprintf("%scd %s && exec %s", exports.String(), shellQuote(workdir), shcmd)
+	chrootCmd := fmt.Sprintf("chroot %s /bin/sh -c %s", shellQuote(rootfs), shellQuote(inner))
+
+	return []string{"unshare", "--user", "--map-root-user", "--mount", "--fork",
+		"/bin/sh", "-c", chrootCmd}
+}
+
+// runInRootfs execs `/bin/sh -c shcmd` chrooted into rootfs, inside a fresh
+// user namespace so that no host privileges are required.
+func runInRootfs(rootfs, workdir string, env map[string]string, shcmd string) error {
+	args := chrootCommandArgs(rootfs, workdir, env, shcmd)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyIntoRootfs copies src (a file in the build context) to dst (an
+// absolute path) inside rootfs, creating parent directories as needed.
+func copyIntoRootfs(rootfs, src, dst string) error {
+	target := filepath.Join(rootfs, dst)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return copyFile(target, src)
+}
+
+// copyDirContents copies the contents of src into dst, which must already
+// exist. Used to pull build results back out of a chrooted rootfs.
+func copyDirContents(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := copyFile(filepath.Join(dst, entry.Name()), filepath.Join(src, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarDir writes the contents of dir to w as a tar stream.
+func tarDir(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// untar extracts a tar stream into dir, which must already exist. dir is
+// untrusted-content boundary: pullImageRootfs feeds it layers pulled
+// straight from a registry, so every entry's target path is checked to
+// stay within dir before anything is written (tar-slip protection).
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := sanitizeTarPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sanitizeTarPath joins dir and name, rejecting any absolute name or any
+// name whose cleaned path would land outside dir (a "tar-slip").
+func sanitizeTarPath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("tar entry %q has an absolute path", name)
+	}
+	target := filepath.Join(dir, name)
+	if target != dir && !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("tar entry %q escapes extraction directory %q", name, dir)
+	}
+	return target, nil
+}
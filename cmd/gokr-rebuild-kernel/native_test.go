@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	const df = `
+FROM debian:stretch
+
+RUN apt-get update
+COPY a /usr/src/a
+ENV FOO bar
+USER builduser
+WORKDIR /usr/src
+ENTRYPOINT /usr/bin/gokr-build-kernel
+`
+	got, err := parseDockerfile(df)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOps := []string{"FROM", "RUN", "COPY", "ENV", "USER", "WORKDIR", "ENTRYPOINT"}
+	if len(got) != len(wantOps) {
+		t.Fatalf("parseDockerfile() returned %d instructions, want %d: %+v", len(got), len(wantOps), got)
+	}
+	for i, op := range wantOps {
+		if got[i].op != op {
+			t.Errorf("instruction %d op = %q, want %q", i, got[i].op, op)
+		}
+	}
+}
+
+func TestTarDirUntarRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := tarDir(src, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := untar(&buf, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, "sub", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("round-tripped file = %q, want %q", got, "hello")
+	}
+}
+
+func TestUntarRejectsPathTraversal(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "../../etc/passwd",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     0,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	dst := t.TempDir()
+	if err := untar(&buf, dst); err == nil {
+		t.Fatal("untar() accepted a path-traversal entry, want error")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(filepath.Dir(dst)), "etc", "passwd")); !os.IsNotExist(err) {
+		t.Fatalf("path-traversal entry escaped the extraction directory")
+	}
+}
+
+func TestUntarRejectsAbsolutePath(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "/etc/passwd",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     0,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	dst := t.TempDir()
+	if err := untar(&buf, dst); err == nil {
+		t.Fatal("untar() accepted an absolute path entry, want error")
+	}
+}
+
+func TestChrootCommandArgsDoesNotDropPrivilege(t *testing.T) {
+	args := chrootCommandArgs("/rootfs", "/usr/src", map[string]string{"FOO": "bar"}, "/usr/bin/gokr-build-kernel")
+	joined := strings.Join(args, " ")
+	if strings.Contains(joined, " su ") {
+		t.Errorf("chrootCommandArgs() = %q, want no su call (map-root-user leaves no second id to drop to)", joined)
+	}
+	if !strings.Contains(joined, "--map-root-user") {
+		t.Errorf("chrootCommandArgs() = %q, want --map-root-user", joined)
+	}
+}
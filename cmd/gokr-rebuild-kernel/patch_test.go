@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoverPatchesSortsByName(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"0101-b.patch", "0001-a.patch", "0102-c.patch"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := discoverPatches(dir, "rpi3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"0001-a.patch", "0101-b.patch", "0102-c.patch"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverPatches() = %v, want %v", got, want)
+	}
+}
+
+func TestDiscoverPatchesSharedSeriesFile(t *testing.T) {
+	dir := t.TempDir()
+	series := "0001-a.patch\n# comment\n\n0002-b.patch -p1\n"
+	if err := os.WriteFile(filepath.Join(dir, "series"), []byte(series), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := discoverPatches(dir, "rpi3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"0001-a.patch", "0002-b.patch"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverPatches() = %v, want %v", got, want)
+	}
+}
+
+func TestDiscoverPatchesTargetSpecificSeriesWins(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "series"), []byte("0001-a.patch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "rpi4"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "rpi4", "series"), []byte("0002-b.patch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := discoverPatches(dir, "rpi4", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0002-b.patch"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverPatches() = %v, want %v", got, want)
+	}
+}
+
+func TestDiscoverPatchesZeroPatchesIsAnErrorByDefault(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := discoverPatches(dir, "rpi3", false); err == nil {
+		t.Fatal("discoverPatches() on an empty dir succeeded, want error")
+	}
+	got, err := discoverPatches(dir, "rpi3", true)
+	if err != nil {
+		t.Fatalf("discoverPatches() with allowZero=true: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("discoverPatches() = %v, want empty", got)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestParseTargetsUnknown(t *testing.T) {
+	if _, err := parseTargets("rpi3,bogus"); err == nil {
+		t.Fatal(`parseTargets("rpi3,bogus") succeeded, want error`)
+	}
+}
+
+func TestParseTargetsKnown(t *testing.T) {
+	got, err := parseTargets("rpi4, rpi3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Name != "rpi4" || got[1].Name != "rpi3" {
+		t.Errorf("parseTargets() = %+v, want [rpi4 rpi3]", got)
+	}
+}